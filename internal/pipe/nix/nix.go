@@ -0,0 +1,1074 @@
+// Package nix provides a Pipe that generates and publishes a nixpkgs package
+// (and, optionally, a Nix flake) for the project.
+package nix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/goreleaser/goreleaser/internal/artifact"
+	"github.com/goreleaser/goreleaser/internal/client"
+	"github.com/goreleaser/goreleaser/pkg/config"
+	"github.com/goreleaser/goreleaser/pkg/context"
+)
+
+const (
+	nixPrefetchURLBin = "nix-prefetch-url"
+	nixPrefetchBin    = "nix-prefetch"
+
+	// zeroHash is used as a placeholder for the sha256 of artifacts we
+	// haven't actually downloaded yet (e.g. while building the derivation
+	// locally, before it is pushed anywhere).
+	zeroHash = "0000000000000000000000000000000000000000000000000000"
+
+	defaultNixpkgsRev = "nixpkgs-unstable"
+)
+
+var (
+	goosNix   = []string{"darwin", "linux"}
+	goarchNix = []string{"amd64", "arm", "arm64", "386"}
+	goarmNix  = []string{"6", "7"}
+
+	errNoRepoName     = errors.New("nix.repository.name is required")
+	errSkipUpload     = errors.New("nix.skip_upload is set")
+	errSkipUploadAuto = errors.New("nix.skip_upload is set to 'auto', and the current version is a pre-release")
+)
+
+type errNoArchivesFound struct {
+	goamd64 string
+	ids     []string
+}
+
+func (e errNoArchivesFound) Error() string {
+	return fmt.Sprintf(
+		"no archives found matching goos=%v goarch=%v goarm=%v goamd64=%s ids=%v",
+		goosNix, goarchNix, goarmNix, e.goamd64, e.ids,
+	)
+}
+
+// shaPrefetcher resolves the sha256 (in nix's sri/base32 format) of a given
+// URL or source. It is implemented differently for the build and publish
+// steps: during build we don't want to hit the network at all, so we emit a
+// zero hash that gets resolved for real during publish.
+type shaPrefetcher interface {
+	Prefetch(url string) (string, error)
+	// PrefetchVendor resolves the vendorHash of a buildGoModule derivation
+	// built from src, for the FromSource build mode.
+	PrefetchVendor(src string) (string, error)
+	Available() bool
+}
+
+type buildShaPrefetcher struct{}
+
+func (buildShaPrefetcher) Prefetch(_ string) (string, error)       { return zeroHash, nil }
+func (buildShaPrefetcher) PrefetchVendor(_ string) (string, error) { return zeroHash, nil }
+func (buildShaPrefetcher) Available() bool                         { return true }
+
+type publishShaPrefetcher struct {
+	bin string
+}
+
+func (p publishShaPrefetcher) Prefetch(url string) (string, error) {
+	bts, err := exec.Command(p.bin, "--type", "sha256", url).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to prefetch %s: %w: %s", url, err, string(bts))
+	}
+	lines := strings.Split(strings.TrimSpace(string(bts)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1]), nil
+}
+
+func (p publishShaPrefetcher) Available() bool {
+	_, err := exec.LookPath(p.bin)
+	return err == nil
+}
+
+// vendorHashPrefetcher shells out to nix-prefetch to compute the SRI hash of
+// a buildGoModule derivation's vendored modules.
+type vendorHashPrefetcher struct {
+	bin string
+}
+
+func (v vendorHashPrefetcher) PrefetchVendor(src string) (string, error) {
+	bts, err := exec.Command(v.bin, "--option", "go-modules", src).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to prefetch vendor hash for %s: %w: %s", src, err, string(bts))
+	}
+	return strings.TrimSpace(string(bts)), nil
+}
+
+// releasePrefetcher is the shaPrefetcher used for publish: it resolves
+// archive hashes via nix-prefetch-url and vendor hashes via nix-prefetch.
+type releasePrefetcher struct {
+	publishShaPrefetcher
+	vendorHashPrefetcher
+}
+
+// binaryCachePusher pushes a built derivation's store paths to a binary
+// cache, analogous to how shaPrefetcher resolves sha256 hashes.
+type binaryCachePusher interface {
+	Push(drvPath string) error
+	Available() bool
+}
+
+// cachixPusher shells out to `cachix push <name>` to upload a built
+// derivation's closure to a Cachix binary cache.
+type cachixPusher struct {
+	name string
+	bin  string
+}
+
+func (c cachixPusher) Push(drvPath string) error {
+	out, err := exec.Command(c.bin, "push", c.name, drvPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to push %s to cachix: %w: %s", drvPath, err, string(out))
+	}
+	return nil
+}
+
+func (c cachixPusher) Available() bool {
+	_, err := exec.LookPath(c.bin)
+	return err == nil
+}
+
+const cachixBin = "cachix"
+
+// Pipe for nix publish.
+type Pipe struct {
+	prefetcher shaPrefetcher
+	pusher     binaryCachePusher
+	// buildDrv builds the derivation at the given path with nix-build and
+	// returns its store path. Defaults to shelling out to nix-build; only
+	// overridden in tests.
+	buildDrv func(path string) (string, error)
+}
+
+func (p Pipe) drvBuilder() func(string) (string, error) {
+	if p.buildDrv != nil {
+		return p.buildDrv
+	}
+	return func(path string) (string, error) {
+		out, err := exec.Command("nix-build", path, "--no-out-link").CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("failed to build %s: %w: %s", path, err, string(out))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+}
+
+// NewPublish returns a new publish pipe for nix.
+func NewPublish() Pipe {
+	return Pipe{
+		prefetcher: releasePrefetcher{
+			publishShaPrefetcher{nixPrefetchURLBin},
+			vendorHashPrefetcher{nixPrefetchBin},
+		},
+	}
+}
+
+func (Pipe) String() string { return "nixpkgs" }
+
+func (Pipe) ContinueOnError() bool { return true }
+
+func (Pipe) Dependencies(_ *context.Context) []string {
+	return []string{nixPrefetchURLBin}
+}
+
+// cachePusher returns the binaryCachePusher to use for the given nix config,
+// defaulting to a real cachixPusher unless one was injected (tests only).
+func (p Pipe) cachePusher(nix config.Nix) binaryCachePusher {
+	if p.pusher != nil {
+		return p.pusher
+	}
+	return cachixPusher{name: nix.Cachix.Name, bin: cachixBin}
+}
+
+// Skip returns true if there are no nix configs, the prefetcher dependency
+// isn't available, or cachix push is enabled and cachix isn't available.
+func (p Pipe) Skip(ctx *context.Context) bool {
+	if len(ctx.Config.Nix) == 0 {
+		return true
+	}
+	if !p.prefetcher.Available() {
+		return true
+	}
+	for _, nix := range ctx.Config.Nix {
+		if nix.Cachix.Push && !p.cachePusher(nix).Available() {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish the nixpkgs package.
+func (p Pipe) Publish(ctx *context.Context) error {
+	cli, err := client.NewReleaseClient(ctx)
+	if err != nil {
+		return err
+	}
+	return p.publishAll(ctx, cli)
+}
+
+func (p Pipe) publishAll(ctx *context.Context, cli client.Client) error {
+	for _, nix := range ctx.Config.Nix {
+		if err := p.doPublish(ctx, nix, cli); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BuildPipe builds the nixpkgs package (and flake, if enabled) locally,
+// without publishing it anywhere.
+type BuildPipe struct{}
+
+// NewBuild returns a new build pipe for nix.
+func NewBuild() BuildPipe { return BuildPipe{} }
+
+func (BuildPipe) String() string { return "nixpkgs" }
+
+// Default sets the Pipe defaults.
+func (BuildPipe) Default(ctx *context.Context) error {
+	for i := range ctx.Config.Nix {
+		nix := &ctx.Config.Nix[i]
+		if nix.Name == "" {
+			nix.Name = ctx.Config.ProjectName
+		}
+		if nix.Path == "" {
+			nix.Path = path.Join("pkgs", nix.Name, "default.nix")
+		}
+		if nix.Goamd64 == "" {
+			nix.Goamd64 = "v1"
+		}
+		if nix.Flake.Enabled && nix.Flake.NixpkgsRev == "" {
+			nix.Flake.NixpkgsRev = defaultNixpkgsRev
+		}
+	}
+	return nil
+}
+
+// Run builds the nixpkgs package.
+func (b BuildPipe) Run(ctx *context.Context) error {
+	cli, err := client.NewReleaseClient(ctx)
+	if err != nil {
+		return err
+	}
+	return b.runAll(ctx, cli)
+}
+
+func (b BuildPipe) runAll(ctx *context.Context, cli client.Client) error {
+	for _, nix := range ctx.Config.Nix {
+		if err := b.doRun(ctx, nix, cli); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func archivesForNix(ctx *context.Context, nix config.Nix) ([]*artifact.Artifact, error) {
+	archives := ctx.Artifacts.Filter(artifact.And(
+		artifact.ByType(artifact.UploadableArchive),
+		artifact.ByIDs(nix.IDs...),
+		artifact.ByGoos(goosNix),
+		artifact.ByGoarch(goarchNix),
+		artifact.Or(
+			artifact.ByGoarm(goarmNix...),
+			artifact.ByGoarm(""),
+		),
+		artifact.ByGoamd64(nix.Goamd64),
+	)).List()
+	if len(archives) == 0 && !nix.FromSource.Enabled {
+		return nil, errNoArchivesFound{
+			goamd64: nix.Goamd64,
+			ids:     nix.IDs,
+		}
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].Name < archives[j].Name
+	})
+	return archives, nil
+}
+
+// completionShells lists the shells whose completion scripts get their own
+// derivation output, in the order they should appear in `outputs`.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// auxOutputs inspects an archive's extra man pages/completions (as recorded
+// by the nfpm/archive pipes in artifact.Extra) and returns the extra
+// `outputs` a multi-output derivation needs to carry them. It returns nothing
+// unless nix.Outputs.Enabled is set; no other field of nix.Outputs is read.
+func auxOutputs(nix config.Nix, archives []*artifact.Artifact) []string {
+	if !nix.Outputs.Enabled {
+		return nil
+	}
+
+	seen := map[string]bool{}
+	var outputs []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			outputs = append(outputs, name)
+		}
+	}
+
+	for _, a := range archives {
+		if manPages, ok := a.Extra[artifact.ExtraManPages].([]string); ok && len(manPages) > 0 {
+			add("man")
+		}
+		if completions, ok := a.Extra[artifact.ExtraCompletions].(map[string]string); ok {
+			for _, shell := range completionShells {
+				if _, ok := completions[shell]; ok {
+					add(shell)
+				}
+			}
+		}
+	}
+	return outputs
+}
+
+// manInstallPhase routes man pages picked up from the archives to
+// installManPage, with the section taken from each file name. The routing is
+// fixed: nix.Outputs is not consulted for overrides.
+func manInstallPhase(nix config.Nix, archives []*artifact.Artifact) []string {
+	var lines []string
+	seen := map[string]bool{}
+	for _, a := range archives {
+		manPages, ok := a.Extra[artifact.ExtraManPages].([]string)
+		if !ok {
+			continue
+		}
+		for _, page := range manPages {
+			if seen[page] {
+				continue
+			}
+			seen[page] = true
+			section := manSection(page)
+			lines = append(lines, fmt.Sprintf(
+				"installManPage --section %s $out/%s", section, page,
+			))
+		}
+	}
+	return lines
+}
+
+func manSection(name string) string {
+	base := strings.TrimSuffix(name, ".gz")
+	idx := strings.LastIndex(base, ".")
+	if idx == -1 || idx == len(base)-1 {
+		return "1"
+	}
+	return base[idx+1:]
+}
+
+// completionInstallPhase routes completion scripts picked up from the
+// archives into each shell's standard completions directory.
+func completionInstallPhase(name string, archives []*artifact.Artifact) []string {
+	dirs := map[string]string{
+		"bash": "$bash/share/bash-completion/completions/" + name,
+		"zsh":  "$zsh/share/zsh/site-functions/_" + name,
+		"fish": "$fish/share/fish/vendor_completions.d/" + name + ".fish",
+	}
+
+	var lines []string
+	seen := map[string]bool{}
+	for _, a := range archives {
+		completions, ok := a.Extra[artifact.ExtraCompletions].(map[string]string)
+		if !ok {
+			continue
+		}
+		for _, shell := range completionShells {
+			src, ok := completions[shell]
+			if !ok || seen[shell] {
+				continue
+			}
+			seen[shell] = true
+			lines = append(lines, fmt.Sprintf("install -D %s %s", src, dirs[shell]))
+		}
+	}
+	return lines
+}
+
+// binInstallFormats renders the nix expression fragments needed to add
+// runtime dependencies to a package's wrapper, grouped by the OS they apply
+// to (if any).
+func binInstallFormats(nix config.Nix) []string {
+	result := make([]string, 0, len(nix.Dependencies))
+	for _, dep := range nix.Dependencies {
+		switch dep.OS {
+		case "linux":
+			result = append(result, fmt.Sprintf("    ++ lib.optionals stdenv.isLinux [ %s ]", dep.Name))
+		case "darwin":
+			result = append(result, fmt.Sprintf("    ++ lib.optionals stdenv.isDarwin [ %s ]", dep.Name))
+		default:
+			result = append(result, fmt.Sprintf("    ++ [ %s ]", dep.Name))
+		}
+	}
+	return result
+}
+
+func applyTemplate(ctx *context.Context, name, tpl string) (string, error) {
+	t, err := template.New(name).Parse(tpl)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, ctx); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+const nixFlakeTpl = `{
+  description = "{{ .Description }}";
+
+  inputs = {
+    nixpkgs.url = "github:NixOS/nixpkgs/{{ .NixpkgsRev }}";
+    flake-utils.url = "github:numtide/flake-utils";
+  };
+
+  outputs = { self, nixpkgs, flake-utils }:
+    flake-utils.lib.eachSystem [
+{{- range .Systems }}
+      "{{ . }}"
+{{- end }}
+    ] (system:
+      let
+        pkgs = import nixpkgs { inherit system; };
+        {{ .Name }} = pkgs.callPackage ./pkgs/{{ .Name }} { };
+      in
+      {
+        packages.default = {{ .Name }};
+        packages.{{ .Name }} = {{ .Name }};
+        apps.default = {
+          type = "app";
+          program = "${ {{- .Name }} }/bin/{{ .Name }}";
+        };
+      });
+}
+`
+
+// nixSystems maps goreleaser's goos/goarch pairs to the nix "system" triples
+// a flake declares outputs for.
+var nixSystems = map[string]string{
+	"linuxamd64":  "x86_64-linux",
+	"linuxarm64":  "aarch64-linux",
+	"linuxarm6":   "armv6l-linux",
+	"linuxarm7":   "armv7l-linux",
+	"darwinamd64": "x86_64-darwin",
+	"darwinarm64": "aarch64-darwin",
+}
+
+func flakeSystems(archives []*artifact.Artifact) []string {
+	seen := map[string]bool{}
+	var systems []string
+	for _, a := range archives {
+		key := a.Goos + a.Goarch + a.Goarm
+		sys, ok := nixSystems[key]
+		if !ok || seen[sys] {
+			continue
+		}
+		seen[sys] = true
+		systems = append(systems, sys)
+	}
+	sort.Strings(systems)
+	return systems
+}
+
+type flakeTplData struct {
+	Name        string
+	Description string
+	NixpkgsRev  string
+	Systems     []string
+}
+
+func buildFlake(ctx *context.Context, nix config.Nix, archives []*artifact.Artifact) (string, error) {
+	t, err := template.New("flake").Parse(nixFlakeTpl)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, flakeTplData{
+		Name:        nix.Name,
+		Description: nix.Description,
+		NixpkgsRev:  nix.Flake.NixpkgsRev,
+		Systems:     flakeSystems(archives),
+	}); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+const flakeLockTpl = `{
+  "nodes": {
+    "nixpkgs": {
+      "locked": {
+        "narHash": "sha256-{{ .NarHash }}",
+        "owner": "NixOS",
+        "repo": "nixpkgs",
+        "rev": "{{ .NixpkgsRev }}",
+        "type": "github"
+      },
+      "original": {
+        "owner": "NixOS",
+        "ref": "{{ .NixpkgsRev }}",
+        "repo": "nixpkgs",
+        "type": "github"
+      }
+    },
+    "root": {
+      "inputs": {
+        "nixpkgs": "nixpkgs"
+      }
+    }
+  },
+  "root": "root",
+  "version": 7
+}
+`
+
+type flakeLockTplData struct {
+	NixpkgsRev string
+	NarHash    string
+}
+
+// buildFlakeLock pins the flake's nixpkgs input to a narHash, resolved via
+// the same shaPrefetcher used for archive hashes, so the published flake.nix
+// is reproducible instead of floating on NixpkgsRev alone.
+func buildFlakeLock(nix config.Nix, prefetcher shaPrefetcher) (string, error) {
+	narHash, err := prefetcher.Prefetch(fmt.Sprintf("https://github.com/NixOS/nixpkgs/archive/%s.tar.gz", nix.Flake.NixpkgsRev))
+	if err != nil {
+		return "", err
+	}
+
+	t, err := template.New("flake-lock").Parse(flakeLockTpl)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, flakeLockTplData{
+		NixpkgsRev: nix.Flake.NixpkgsRev,
+		NarHash:    narHash,
+	}); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// renderTemplates applies the Go templates allowed in the user-facing nix
+// fields and returns a copy of nix with the rendered values filled in. It is
+// shared by the build and publish steps so both actually use what the user
+// configured, instead of only validating that the templates parse.
+func renderTemplates(ctx *context.Context, nix config.Nix) (config.Nix, error) {
+	name, err := applyTemplate(ctx, "nix-name", nix.Name)
+	if err != nil {
+		return nix, err
+	}
+	nix.Name = name
+
+	if nix.Description, err = applyTemplate(ctx, "nix-description", nix.Description); err != nil {
+		return nix, err
+	}
+	if nix.Homepage, err = applyTemplate(ctx, "nix-homepage", nix.Homepage); err != nil {
+		return nix, err
+	}
+
+	if nix.Repository.Name == "" {
+		return nix, errNoRepoName
+	}
+	if nix.Repository.Name, err = applyTemplate(ctx, "nix-repo-name", nix.Repository.Name); err != nil {
+		return nix, err
+	}
+	if nix.SkipUpload, err = applyTemplate(ctx, "nix-skip-upload", nix.SkipUpload); err != nil {
+		return nix, err
+	}
+	if nix.Install, err = applyTemplate(ctx, "nix-install", nix.Install); err != nil {
+		return nix, err
+	}
+	if nix.PostInstall, err = applyTemplate(ctx, "nix-post-install", nix.PostInstall); err != nil {
+		return nix, err
+	}
+	if nix.Path, err = applyTemplate(ctx, "nix-path", nix.Path); err != nil {
+		return nix, err
+	}
+	// the url template is rendered once per archive (it references
+	// per-artifact fields), so here we only validate that it parses and
+	// executes against a representative data set.
+	if _, err := renderArchiveURL(nix.URLTemplate, urlTplData{}); err != nil {
+		return nix, err
+	}
+	return nix, nil
+}
+
+func (b BuildPipe) doRun(ctx *context.Context, nix config.Nix, cli client.Client) error {
+	nix, err := renderTemplates(ctx, nix)
+	if err != nil {
+		return err
+	}
+
+	archives, err := archivesForNix(ctx, nix)
+	if err != nil {
+		return err
+	}
+
+	content, err := buildPkg(ctx, nix, archives, buildShaPrefetcher{})
+	if err != nil {
+		return err
+	}
+
+	path := artifact.Path(ctx, "nix", nix.Name, "default.nix")
+	if err := artifact.WriteFile(path, []byte(content)); err != nil {
+		return err
+	}
+	ctx.Artifacts.Add(&artifact.Artifact{
+		Name: nix.Name + "_default.nix",
+		Path: path,
+		Type: artifact.Nixpkg,
+		Extra: map[string]interface{}{
+			artifact.ExtraID: nix.Name,
+		},
+	})
+
+	if nix.Flake.Enabled {
+		flake, err := buildFlake(ctx, nix, archives)
+		if err != nil {
+			return err
+		}
+		flakePath := artifact.Path(ctx, "nix", nix.Name, "flake.nix")
+		if err := artifact.WriteFile(flakePath, []byte(flake)); err != nil {
+			return err
+		}
+		ctx.Artifacts.Add(&artifact.Artifact{
+			Name: nix.Name + "_flake.nix",
+			Path: flakePath,
+			Type: artifact.Nixpkg,
+			Extra: map[string]interface{}{
+				artifact.ExtraID: nix.Name,
+			},
+		})
+	}
+
+	return nil
+}
+
+// urlTplData is the data a nix.URLTemplate is rendered against: one archive
+// at a time.
+type urlTplData struct {
+	Tag          string
+	Version      string
+	ArtifactName string
+}
+
+const defaultURLTemplate = `https://dummyhost/download/{{ .Tag }}/{{ .ArtifactName }}`
+
+func renderArchiveURL(tpl string, data urlTplData) (string, error) {
+	if tpl == "" {
+		tpl = defaultURLTemplate
+	}
+	t, err := template.New("nix-url").Parse(tpl)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+func archiveURL(ctx *context.Context, nix config.Nix, a *artifact.Artifact) (string, error) {
+	return renderArchiveURL(nix.URLTemplate, urlTplData{
+		Tag:          ctx.Git.CurrentTag,
+		Version:      ctx.Version,
+		ArtifactName: a.Name,
+	})
+}
+
+// archiveSource is a single `fetchurl` source, keyed by the nix system it
+// targets.
+type archiveSource struct {
+	System string
+	URL    string
+	SHA256 string
+}
+
+// archiveSources resolves the fetchurl source (url + sha256) for every
+// archive we recognize a nix system for.
+func archiveSources(ctx *context.Context, nix config.Nix, archives []*artifact.Artifact, prefetcher shaPrefetcher) ([]archiveSource, error) {
+	var sources []archiveSource
+	for _, a := range archives {
+		system, ok := nixSystems[a.Goos+a.Goarch+a.Goarm]
+		if !ok {
+			continue
+		}
+		url, err := archiveURL(ctx, nix, a)
+		if err != nil {
+			return nil, err
+		}
+		sha, err := prefetcher.Prefetch(url)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, archiveSource{System: system, URL: url, SHA256: sha})
+	}
+	return sources, nil
+}
+
+const defaultInstallPhase = `mkdir -p $out/bin
+cp %s $out/bin/`
+
+func buildPkg(ctx *context.Context, nix config.Nix, archives []*artifact.Artifact, prefetcher shaPrefetcher) (string, error) {
+	if nix.FromSource.Enabled {
+		return buildFromSourcePkg(ctx, nix, prefetcher)
+	}
+
+	sources, err := archiveSources(ctx, nix, archives, prefetcher)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "{ lib, stdenv, fetchurl, installShellFiles }:\n\n")
+	fmt.Fprintf(&buf, "stdenv.mkDerivation rec {\n  pname = %q;\n  version = %q;\n\n", nix.Name, ctx.Version)
+
+	if outputs := auxOutputs(nix, archives); len(outputs) > 0 {
+		fmt.Fprintf(&buf, "  outputs = [ \"out\" %s ];\n\n", quoteAll(outputs))
+	}
+
+	buf.WriteString("  sources = {\n")
+	for _, s := range sources {
+		fmt.Fprintf(&buf, "    %s = { url = %q; sha256 = %q; };\n", s.System, s.URL, s.SHA256)
+	}
+	buf.WriteString("  };\n\n")
+	buf.WriteString("  src = fetchurl sources.${stdenv.hostPlatform.system};\n\n")
+
+	buf.WriteString("  buildInputs = [ ]\n")
+	for _, line := range binInstallFormats(nix) {
+		fmt.Fprintln(&buf, line)
+	}
+	buf.WriteString("    ;\n\n")
+
+	install := nix.Install
+	if install == "" {
+		install = fmt.Sprintf(defaultInstallPhase, nix.Name)
+	}
+	fmt.Fprintf(&buf, "  installPhase = ''\n%s\n", indent(install))
+	if nix.Outputs.Enabled {
+		for _, line := range manInstallPhase(nix, archives) {
+			fmt.Fprintln(&buf, indent(line))
+		}
+		for _, line := range completionInstallPhase(nix.Name, archives) {
+			fmt.Fprintln(&buf, indent(line))
+		}
+	}
+	buf.WriteString("  '';\n\n")
+
+	if nix.PostInstall != "" {
+		fmt.Fprintf(&buf, "  postInstall = ''\n%s\n  '';\n\n", indent(nix.PostInstall))
+	}
+
+	fmt.Fprintf(&buf, "  meta = {\n    description = %q;\n    homepage = %q;\n", nix.Description, nix.Homepage)
+	if nix.License != "" {
+		fmt.Fprintf(&buf, "    license = lib.licenses.%s;\n", nix.License)
+	}
+	buf.WriteString("  };\n")
+
+	fmt.Fprintf(&buf, "}\n")
+	return buf.String(), nil
+}
+
+func indent(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	for i, l := range lines {
+		lines[i] = "    " + strings.TrimSpace(l)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func buildFromSourcePkg(ctx *context.Context, nix config.Nix, prefetcher shaPrefetcher) (string, error) {
+	src := fmt.Sprintf("https://github.com/%s/%s/archive/%s.tar.gz", nix.Repository.Owner, nix.Repository.Name, ctx.Git.CurrentTag)
+
+	srcHash, err := prefetcher.Prefetch(src)
+	if err != nil {
+		return "", err
+	}
+
+	vendorHash := nix.FromSource.VendorHash
+	if vendorHash == "" {
+		h, err := prefetcher.PrefetchVendor(src)
+		if err != nil {
+			return "", err
+		}
+		vendorHash = h
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "{ lib, buildGoModule, fetchFromGitHub }:\n\n")
+	fmt.Fprintf(&buf, "buildGoModule rec {\n  pname = %q;\n  version = %q;\n\n", nix.Name, ctx.Version)
+	fmt.Fprintf(&buf, "  src = fetchFromGitHub {\n    owner = %q;\n    repo = %q;\n    rev = %q;\n    hash = %q;\n  };\n\n",
+		nix.Repository.Owner, nix.Repository.Name, ctx.Git.CurrentTag, srcHash)
+	fmt.Fprintf(&buf, "  vendorHash = %q;\n", vendorHash)
+	if len(nix.FromSource.Subpackages) > 0 {
+		fmt.Fprintf(&buf, "  subPackages = [ %s ];\n", quoteAll(nix.FromSource.Subpackages))
+	}
+	if nix.FromSource.Ldflags != "" {
+		fmt.Fprintf(&buf, "  ldflags = [ %q ];\n", nix.FromSource.Ldflags)
+	}
+	if len(nix.FromSource.Tags) > 0 {
+		fmt.Fprintf(&buf, "  tags = [ %s ];\n", quoteAll(nix.FromSource.Tags))
+	}
+	for _, line := range binInstallFormats(nix) {
+		fmt.Fprintln(&buf, line)
+	}
+	fmt.Fprintf(&buf, "}\n")
+	return buf.String(), nil
+}
+
+func quoteAll(ss []string) string {
+	quoted := make([]string, len(ss))
+	for i, s := range ss {
+		quoted[i] = strconv.Quote(s)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (p Pipe) doPublish(ctx *context.Context, nix config.Nix, cli client.Client) error {
+	nix, err := renderTemplates(ctx, nix)
+	if err != nil {
+		return err
+	}
+
+	if nix.SkipUpload == "true" {
+		return errSkipUpload
+	}
+	if nix.SkipUpload == "auto" && ctx.Semver.Prerelease != "" {
+		return errSkipUploadAuto
+	}
+
+	archives, err := archivesForNix(ctx, nix)
+	if err != nil {
+		return err
+	}
+
+	content, err := buildPkg(ctx, nix, archives, p.prefetcher)
+	if err != nil {
+		return err
+	}
+
+	msg, err := commitMessage(ctx, nix)
+	if err != nil {
+		return err
+	}
+
+	repo := client.RepoFromRef(nix.Repository)
+	if err := cli.CreateFile(ctx, nix.CommitAuthor, repo, []byte(content), nix.Path, msg); err != nil {
+		return err
+	}
+
+	if nix.Flake.Enabled {
+		flake, err := buildFlake(ctx, nix, archives)
+		if err != nil {
+			return err
+		}
+		flakePath := path.Join(path.Dir(nix.Path), "flake.nix")
+		if err := cli.CreateFile(ctx, nix.CommitAuthor, repo, []byte(flake), flakePath, msg); err != nil {
+			return err
+		}
+		lock, err := buildFlakeLock(nix, p.prefetcher)
+		if err != nil {
+			return err
+		}
+		lockPath := path.Join(path.Dir(nix.Path), "flake.lock")
+		if err := cli.CreateFile(ctx, nix.CommitAuthor, repo, []byte(lock), lockPath, msg); err != nil {
+			return err
+		}
+	}
+
+	switch nix.RepoLayout {
+	case repoLayoutNUR:
+		existing, err := existingFileContent(ctx, cli, repo, "default.nix")
+		if err != nil {
+			return err
+		}
+		names := mergeNames(existing, nurNames(ctx.Config.Nix))
+		if err := cli.CreateFile(ctx, nix.CommitAuthor, repo, []byte(nurDefaultContent(names)), "default.nix", msg); err != nil {
+			return err
+		}
+	case repoLayoutOverlay:
+		existing, err := existingFileContent(ctx, cli, repo, "overlay.nix")
+		if err != nil {
+			return err
+		}
+		names := mergeNames(existing, overlayNames(ctx.Config.Nix))
+		if err := cli.CreateFile(ctx, nix.CommitAuthor, repo, []byte(overlayContent(names)), "overlay.nix", msg); err != nil {
+			return err
+		}
+	}
+
+	if nix.Repository.PullRequest.Enabled {
+		if err := cli.OpenPullRequest(ctx, repo, repo, msg, nix.Repository.PullRequest.Draft); err != nil {
+			return err
+		}
+	}
+
+	if nix.Cachix.Push {
+		localPath := artifact.Path(ctx, "nix", nix.Name, "default.nix")
+		if err := artifact.WriteFile(localPath, []byte(content)); err != nil {
+			return err
+		}
+		drvPath, err := p.drvBuilder()(localPath)
+		if err != nil {
+			return err
+		}
+		if err := p.cachePusher(nix).Push(drvPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const (
+	repoLayoutSingle  = ""
+	repoLayoutNUR     = "nur"
+	repoLayoutOverlay = "overlay"
+)
+
+// nurNames returns the sorted, deduped names of the packages in this
+// project that opt into the "nur" repository layout.
+func nurNames(nixes []config.Nix) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, n := range nixes {
+		if n.RepoLayout == repoLayoutNUR && n.Name != "" && !seen[n.Name] {
+			seen[n.Name] = true
+			names = append(names, n.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// overlayNames returns the sorted, deduped names of the packages in this
+// project that opt into the "overlay" repository layout.
+func overlayNames(nixes []config.Nix) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, n := range nixes {
+		if n.RepoLayout == repoLayoutOverlay && n.Name != "" && !seen[n.Name] {
+			seen[n.Name] = true
+			names = append(names, n.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// nurDefaultContent renders the top-level default.nix a NUR repository
+// needs, re-exporting the given packages via callPackage. names is expected
+// to already be merged with whatever the repository currently has, so that
+// publishing from one project doesn't drop another project's entries.
+func nurDefaultContent(names []string) string {
+	var buf bytes.Buffer
+	buf.WriteString("{ pkgs ? import <nixpkgs> { } }:\n\n{\n")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "  %s = pkgs.callPackage ./pkgs/%s { };\n", name, name)
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// overlayContent renders the overlay.nix a cross-distro user repository
+// needs, exposing the given packages through final.callPackage. Like
+// nurDefaultContent, names is expected to already be merged with the
+// repository's existing entries.
+func overlayContent(names []string) string {
+	var buf bytes.Buffer
+	buf.WriteString("final: prev: {\n")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "  %s = final.callPackage ./pkgs/%s { };\n", name, name)
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// nurEntryRe matches a single package entry in a NUR default.nix or overlay
+// overlay.nix, capturing its name.
+var nurEntryRe = regexp.MustCompile(`(?m)^\s*([A-Za-z0-9_-]+)\s*=\s*(?:pkgs|final)\.callPackage\s+\./pkgs/[A-Za-z0-9_-]+\s*\{\s*\};\s*$`)
+
+// existingNames extracts the package names already present in a
+// previously-published default.nix/overlay.nix, so they can be merged with
+// this run's names instead of being dropped.
+func existingNames(content []byte) []string {
+	var names []string
+	for _, m := range nurEntryRe.FindAllSubmatch(content, -1) {
+		names = append(names, string(m[1]))
+	}
+	return names
+}
+
+// mergeNames unions a repository's existing package names with this run's
+// names, so every project sharing the repository keeps its entry.
+func mergeNames(existing []byte, current []string) []string {
+	seen := map[string]bool{}
+	var merged []string
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			merged = append(merged, name)
+		}
+	}
+	for _, name := range existingNames(existing) {
+		add(name)
+	}
+	for _, name := range current {
+		add(name)
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// errFileNotExist is the sentinel a fileContentGetter implementation should
+// return (wrapped or not) when the requested file does not exist yet. Any
+// other error is a genuine read failure and must not be treated as "no
+// existing content".
+var errFileNotExist = errors.New("file does not exist")
+
+// fileContentGetter is an optional capability of client.Client
+// implementations that can read back a file's current content. It lets
+// doPublish merge into a shared NUR/overlay repository instead of
+// overwriting it; clients that don't support it are treated as if the file
+// doesn't exist yet.
+type fileContentGetter interface {
+	GetFileContent(ctx *context.Context, repo client.Repo, path string) ([]byte, error)
+}
+
+// existingFileContent returns the current content of path in repo, or nil if
+// it doesn't exist yet or cli doesn't support reading it back. Any other
+// error from the read is propagated, since treating it as "no existing
+// content" would overwrite the file and silently drop every other project's
+// entries on a transient failure.
+func existingFileContent(ctx *context.Context, cli client.Client, repo client.Repo, path string) ([]byte, error) {
+	getter, ok := cli.(fileContentGetter)
+	if !ok {
+		return nil, nil
+	}
+	content, err := getter.GetFileContent(ctx, repo, path)
+	if err != nil {
+		if errors.Is(err, errFileNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return content, nil
+}
+
+func commitMessage(ctx *context.Context, nix config.Nix) (string, error) {
+	return fmt.Sprintf("%s: updated to %s", nix.Name, ctx.Git.CurrentTag), nil
+}
@@ -1,18 +1,20 @@
 package nix
 
 import (
-	"html/template"
+	"errors"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
+	"text/template"
 
 	"github.com/goreleaser/goreleaser/internal/artifact"
 	"github.com/goreleaser/goreleaser/internal/client"
 	"github.com/goreleaser/goreleaser/internal/golden"
 	"github.com/goreleaser/goreleaser/internal/testctx"
 	"github.com/goreleaser/goreleaser/pkg/config"
+	"github.com/goreleaser/goreleaser/pkg/context"
 	"github.com/stretchr/testify/require"
 )
 
@@ -39,9 +41,22 @@ func TestSkip(t *testing.T) {
 			Nix: []config.Nix{{}},
 		})))
 	})
+	t.Run("cachix-push-not-in-path", func(t *testing.T) {
+		pipe := Pipe{prefetcher: fakeNixShaPrefetcher{}, pusher: &fakeBinaryCachePusher{available: false}}
+		require.True(t, pipe.Skip(testctx.NewWithCfg(config.Project{
+			Nix: []config.Nix{{Cachix: config.NixCachix{Push: true}}},
+		})))
+	})
+	t.Run("cachix-push-available", func(t *testing.T) {
+		pipe := Pipe{prefetcher: fakeNixShaPrefetcher{}, pusher: &fakeBinaryCachePusher{available: true}}
+		require.False(t, pipe.Skip(testctx.NewWithCfg(config.Project{
+			Nix: []config.Nix{{Cachix: config.NixCachix{Push: true}}},
+		})))
+	})
 }
 
 const fakeNixPrefetchURLBin = "fake-nix-prefetch-url"
+const fakeNixPrefetchBin = "fake-nix-prefetch"
 
 func TestPrefetcher(t *testing.T) {
 	t.Run("prefetch", func(t *testing.T) {
@@ -62,6 +77,19 @@ func TestPrefetcher(t *testing.T) {
 			})
 		})
 	})
+	t.Run("prefetch-vendor", func(t *testing.T) {
+		t.Run("build", func(t *testing.T) {
+			sha, err := buildShaPrefetcher{}.PrefetchVendor("any")
+			require.NoError(t, err)
+			require.Equal(t, zeroHash, sha)
+		})
+		t.Run("publish", func(t *testing.T) {
+			t.Run("no-nix-prefetch", func(t *testing.T) {
+				_, err := vendorHashPrefetcher{fakeNixPrefetchBin}.PrefetchVendor("any")
+				require.ErrorIs(t, err, exec.ErrNotFound)
+			})
+		})
+	})
 	t.Run("available", func(t *testing.T) {
 		t.Run("build", func(t *testing.T) {
 			require.True(t, buildShaPrefetcher{}.Available())
@@ -208,6 +236,150 @@ func TestRunPipe(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "flake",
+			nix: config.Nix{
+				Name:        "flake",
+				IDs:         []string{"foo"},
+				Description: "my test",
+				Homepage:    "https://goreleaser.com",
+				License:     "mit",
+				Repository: config.RepoRef{
+					Owner: "foo",
+					Name:  "bar",
+				},
+				Flake: config.NixFlake{
+					Enabled: true,
+				},
+			},
+		},
+		{
+			name: "flake-pinned-nixpkgs",
+			nix: config.Nix{
+				Name:        "flake-pinned-nixpkgs",
+				IDs:         []string{"foo"},
+				Description: "my test",
+				Homepage:    "https://goreleaser.com",
+				License:     "mit",
+				Repository: config.RepoRef{
+					Owner: "foo",
+					Name:  "bar",
+				},
+				Flake: config.NixFlake{
+					Enabled:    true,
+					NixpkgsRev: "abc123def456",
+				},
+			},
+		},
+		{
+			name: "from-source",
+			nix: config.Nix{
+				Name:        "from-source",
+				IDs:         []string{"foo"},
+				Description: "my test",
+				Homepage:    "https://goreleaser.com",
+				License:     "mit",
+				Repository: config.RepoRef{
+					Owner: "foo",
+					Name:  "bar",
+				},
+				FromSource: config.NixFromSource{
+					Enabled: true,
+				},
+			},
+		},
+		{
+			name: "from-source-preset-vendor-hash",
+			nix: config.Nix{
+				Name:        "from-source-preset-vendor-hash",
+				IDs:         []string{"foo"},
+				Description: "my test",
+				Homepage:    "https://goreleaser.com",
+				License:     "mit",
+				Repository: config.RepoRef{
+					Owner: "foo",
+					Name:  "bar",
+				},
+				FromSource: config.NixFromSource{
+					Enabled:     true,
+					VendorHash:  "sha256-abc123def456abc123def456abc123def456abc123=",
+					Subpackages: []string{"./cmd/foo"},
+					Ldflags:     "-s -w",
+					Tags:        []string{"netgo"},
+				},
+			},
+		},
+		{
+			name: "from-source-no-archives",
+			nix: config.Nix{
+				Name:        "from-source-no-archives",
+				IDs:         []string{"does-not-exist"},
+				Description: "my test",
+				Homepage:    "https://goreleaser.com",
+				License:     "mit",
+				Repository: config.RepoRef{
+					Owner: "foo",
+					Name:  "bar",
+				},
+				FromSource: config.NixFromSource{
+					Enabled: true,
+				},
+			},
+		},
+		{
+			name: "multi-output",
+			nix: config.Nix{
+				Name:        "multi-output",
+				IDs:         []string{"multi-output"},
+				Description: "my test",
+				Homepage:    "https://goreleaser.com",
+				License:     "mit",
+				Dependencies: []config.NixDependency{
+					{Name: "fish"},
+				},
+				Outputs: config.NixOutputs{
+					Enabled: true,
+				},
+				Repository: config.RepoRef{
+					Owner: "foo",
+					Name:  "bar",
+				},
+			},
+		},
+		{
+			name: "man-only",
+			nix: config.Nix{
+				Name:        "man-only",
+				IDs:         []string{"man-only"},
+				Description: "my test",
+				Homepage:    "https://goreleaser.com",
+				License:     "mit",
+				Outputs: config.NixOutputs{
+					Enabled: true,
+				},
+				Repository: config.RepoRef{
+					Owner: "foo",
+					Name:  "bar",
+				},
+			},
+		},
+		{
+			name: "completions-only",
+			nix: config.Nix{
+				Name:        "completions-only",
+				IDs:         []string{"completions-only"},
+				Description: "my test",
+				Homepage:    "https://goreleaser.com",
+				License:     "mit",
+				Outputs: config.NixOutputs{
+					Enabled: true,
+				},
+				Repository: config.RepoRef{
+					Owner: "foo",
+					Name:  "bar",
+				},
+			},
+		},
 		{
 			name: "partial",
 			nix: config.Nix{
@@ -424,20 +596,35 @@ func TestRunPipe(t *testing.T) {
 					createFakeArtifact("unibin", goos, goarch, "", "", nil)
 					createFakeArtifact("unibin-replaces", goos, goarch, "", "", nil)
 					createFakeArtifact("wrapped-in-dir", goos, goarch, "", "", map[string]any{artifact.ExtraWrappedIn: "./foo"})
+					if goos == "linux" && goarch == "amd64" {
+						createFakeArtifact("multi-output", goos, goarch, "", "", map[string]any{
+							artifact.ExtraManPages:    []string{"foo.1.gz"},
+							artifact.ExtraCompletions: map[string]string{"bash": "completions/foo.bash", "zsh": "completions/_foo", "fish": "completions/foo.fish"},
+						})
+						createFakeArtifact("man-only", goos, goarch, "", "", map[string]any{
+							artifact.ExtraManPages: []string{"foo.1.gz"},
+						})
+						createFakeArtifact("completions-only", goos, goarch, "", "", map[string]any{
+							artifact.ExtraCompletions: map[string]string{"bash": "completions/foo.bash", "zsh": "completions/_foo"},
+						})
+					}
 				}
 			}
 
-			client := client.NewMock()
+			mock := client.NewMock()
+			cli := &recordingClient{Client: mock}
 			bpipe := NewBuild()
 			ppipe := Pipe{
 				fakeNixShaPrefetcher{
-					"https://dummyhost/download/v1.2.1/foo_linux_amd64v1.tar.gz":  "sha1",
-					"https://dummyhost/download/v1.2.1/foo_linux_arm64.tar.gz":    "sha2",
-					"https://dummyhost/download/v1.2.1/foo_darwin_amd64v1.tar.gz": "sha3",
-					"https://dummyhost/download/v1.2.1/foo_darwin_arm64.tar.gz":   "sha4",
-					"https://dummyhost/download/v1.2.1/foo_darwin_all.tar.gz":     "sha5",
-					"https://dummyhost/download/v1.2.1/foo_linux_arm6.tar.gz":     "sha6",
-					"https://dummyhost/download/v1.2.1/foo_linux_arm7.tar.gz":     "sha7",
+					"https://dummyhost/download/v1.2.1/foo_linux_amd64v1.tar.gz":       "sha1",
+					"https://dummyhost/download/v1.2.1/foo_linux_arm64.tar.gz":         "sha2",
+					"https://dummyhost/download/v1.2.1/foo_darwin_amd64v1.tar.gz":      "sha3",
+					"https://dummyhost/download/v1.2.1/foo_darwin_arm64.tar.gz":        "sha4",
+					"https://dummyhost/download/v1.2.1/foo_darwin_all.tar.gz":          "sha5",
+					"https://dummyhost/download/v1.2.1/foo_linux_arm6.tar.gz":          "sha6",
+					"https://dummyhost/download/v1.2.1/foo_linux_arm7.tar.gz":          "sha7",
+					"https://github.com/NixOS/nixpkgs/archive/nixpkgs-unstable.tar.gz": "flakesha1",
+					"https://github.com/NixOS/nixpkgs/archive/abc123def456.tar.gz":     "flakesha2",
 				},
 			}
 
@@ -446,41 +633,254 @@ func TestRunPipe(t *testing.T) {
 
 			// run
 			if tt.expectRunErrorIs != nil {
-				err := bpipe.runAll(ctx, client)
+				err := bpipe.runAll(ctx, cli)
 				require.ErrorAs(t, err, &tt.expectPublishErrorIs)
 				return
 			}
-			require.NoError(t, bpipe.runAll(ctx, client))
+			require.NoError(t, bpipe.runAll(ctx, cli))
 			bts, err := os.ReadFile(ctx.Artifacts.Filter(artifact.ByType(artifact.Nixpkg)).Paths()[0])
 			require.NoError(t, err)
 			golden.RequireEqualExt(t, bts, "_build.nix")
 
 			// publish
 			if tt.expectPublishErrorIs != nil {
-				err := ppipe.publishAll(ctx, client)
+				err := ppipe.publishAll(ctx, cli)
 				require.ErrorAs(t, err, &tt.expectPublishErrorIs)
 				return
 			}
-			require.NoError(t, ppipe.publishAll(ctx, client))
-			require.True(t, client.CreatedFile)
-			golden.RequireEqualExt(t, []byte(client.Content), "_publish.nix")
-			require.NotContains(t, client.Content, strings.Repeat("0", 52))
+			require.NoError(t, ppipe.publishAll(ctx, cli))
+			require.True(t, mock.CreatedFile)
+			require.NotEmpty(t, cli.writes)
+			mainWrite := cli.writes[0]
+			golden.RequireEqualExt(t, []byte(mainWrite.content), "_publish.nix")
+			require.NotContains(t, mainWrite.content, strings.Repeat("0", 52))
 
 			if tt.nix.Repository.PullRequest.Enabled {
-				require.True(t, client.OpenedPullRequest)
+				require.True(t, mock.OpenedPullRequest)
 			}
 			if tt.nix.Path != "" {
-				require.Equal(t, tt.nix.Path, client.Path)
+				require.Equal(t, tt.nix.Path, mainWrite.path)
 			} else {
 				if tt.nix.Name == "" {
 					tt.nix.Name = "foo"
 				}
-				require.Equal(t, "pkgs/"+tt.nix.Name+"/default.nix", client.Path)
+				require.Equal(t, "pkgs/"+tt.nix.Name+"/default.nix", mainWrite.path)
+			}
+
+			if tt.nix.Flake.Enabled {
+				require.Len(t, cli.writes, 3)
+				require.Contains(t, cli.writes[1].path, "flake.nix")
+				require.Contains(t, cli.writes[2].path, "flake.lock")
 			}
 		})
 	}
 }
 
+// recordingClient wraps a client.Client and keeps track of every file it was
+// asked to write, so tests can assert on the full set of writes instead of
+// just the last one.
+type recordingClient struct {
+	client.Client
+	writes []recordedWrite
+}
+
+type recordedWrite struct {
+	path    string
+	content string
+}
+
+func (r *recordingClient) CreateFile(ctx *context.Context, author config.CommitAuthor, repo client.Repo, content []byte, path, msg string) error {
+	r.writes = append(r.writes, recordedWrite{path: path, content: string(content)})
+	return r.Client.CreateFile(ctx, author, repo, content, path, msg)
+}
+
+// GetFileContent forwards to the wrapped client when it supports
+// fileContentGetter, so wrapping with recordingClient doesn't hide that
+// capability from callers that type-assert for it. When the wrapped client
+// doesn't support it, every file is reported as not existing yet.
+func (r *recordingClient) GetFileContent(ctx *context.Context, repo client.Repo, path string) ([]byte, error) {
+	getter, ok := r.Client.(fileContentGetter)
+	if !ok {
+		return nil, errFileNotExist
+	}
+	return getter.GetFileContent(ctx, repo, path)
+}
+
+func TestRepoLayouts(t *testing.T) {
+	newCtx := func(nixes []config.Nix) *context.Context {
+		ctx := testctx.NewWithCfg(config.Project{
+			Nix: nixes,
+		}, testctx.WithCurrentTag("v1.2.1"))
+		for _, n := range nixes {
+			ctx.Artifacts.Add(&artifact.Artifact{
+				Name: n.Name + ".tar.gz",
+				Goos: "linux", Goarch: "amd64",
+				Type: artifact.UploadableArchive,
+				Extra: map[string]interface{}{
+					artifact.ExtraID:        n.Name,
+					artifact.ExtraFormat:    "tar.gz",
+					artifact.ExtraBinaries:  []string{n.Name},
+					artifact.ExtraWrappedIn: "",
+				},
+			})
+		}
+		return ctx
+	}
+
+	t.Run("nur", func(t *testing.T) {
+		foo := config.Nix{Name: "foo", Path: "pkgs/foo/default.nix", RepoLayout: "nur", Repository: config.RepoRef{Owner: "o", Name: "r"}}
+		bar := config.Nix{Name: "bar", Path: "pkgs/bar/default.nix", RepoLayout: "nur", Repository: config.RepoRef{Owner: "o", Name: "r"}}
+		ctx := newCtx([]config.Nix{foo, bar})
+		cli := &recordingClient{Client: client.NewMock()}
+
+		p := Pipe{prefetcher: fakeNixShaPrefetcher{}}
+		require.NoError(t, p.doPublish(ctx, foo, cli))
+
+		require.Len(t, cli.writes, 2)
+		require.Equal(t, "pkgs/foo/default.nix", cli.writes[0].path)
+		require.Equal(t, "default.nix", cli.writes[1].path)
+
+		require.NoError(t, p.doPublish(ctx, bar, cli))
+		require.Len(t, cli.writes, 4)
+		require.Equal(t, "pkgs/bar/default.nix", cli.writes[2].path)
+		require.Equal(t, "default.nix", cli.writes[3].path)
+		require.Contains(t, cli.writes[3].content, "bar = pkgs.callPackage ./pkgs/bar { };")
+		require.Contains(t, cli.writes[3].content, "foo = pkgs.callPackage ./pkgs/foo { };")
+	})
+
+	t.Run("overlay", func(t *testing.T) {
+		foo := config.Nix{Name: "foo", Path: "pkgs/foo/default.nix", RepoLayout: "overlay", Repository: config.RepoRef{Owner: "o", Name: "r"}}
+		ctx := newCtx([]config.Nix{foo})
+		cli := &recordingClient{Client: client.NewMock()}
+
+		p := Pipe{prefetcher: fakeNixShaPrefetcher{}}
+		require.NoError(t, p.doPublish(ctx, foo, cli))
+
+		require.Len(t, cli.writes, 2)
+		require.Equal(t, "overlay.nix", cli.writes[1].path)
+		require.Contains(t, cli.writes[1].content, "final: prev: {")
+		require.Contains(t, cli.writes[1].content, "foo = final.callPackage ./pkgs/foo { };")
+	})
+
+	t.Run("single is unaffected", func(t *testing.T) {
+		foo := config.Nix{Name: "foo", Path: "pkgs/foo/default.nix", Repository: config.RepoRef{Owner: "o", Name: "r"}}
+		ctx := newCtx([]config.Nix{foo})
+		cli := &recordingClient{Client: client.NewMock()}
+
+		p := Pipe{prefetcher: fakeNixShaPrefetcher{}}
+		require.NoError(t, p.doPublish(ctx, foo, cli))
+		require.Len(t, cli.writes, 1)
+	})
+
+	t.Run("merges with another project's existing entries", func(t *testing.T) {
+		foo := config.Nix{Name: "foo", Path: "pkgs/foo/default.nix", RepoLayout: "nur", Repository: config.RepoRef{Owner: "o", Name: "r"}}
+		ctx := newCtx([]config.Nix{foo})
+		cli := &recordingClient{Client: &fakeFileGetterClient{
+			Client: client.NewMock(),
+			files: map[string][]byte{
+				"default.nix": []byte("{ pkgs ? import <nixpkgs> { } }:\n\n{\n  bar = pkgs.callPackage ./pkgs/bar { };\n}\n"),
+			},
+		}}
+
+		p := Pipe{prefetcher: fakeNixShaPrefetcher{}}
+		require.NoError(t, p.doPublish(ctx, foo, cli))
+
+		require.Len(t, cli.writes, 2)
+		require.Equal(t, "default.nix", cli.writes[1].path)
+		require.Contains(t, cli.writes[1].content, "bar = pkgs.callPackage ./pkgs/bar { };")
+		require.Contains(t, cli.writes[1].content, "foo = pkgs.callPackage ./pkgs/foo { };")
+	})
+
+	t.Run("a read failure aborts instead of overwriting", func(t *testing.T) {
+		foo := config.Nix{Name: "foo", Path: "pkgs/foo/default.nix", RepoLayout: "nur", Repository: config.RepoRef{Owner: "o", Name: "r"}}
+		ctx := newCtx([]config.Nix{foo})
+		cli := &recordingClient{Client: &fakeFileGetterClient{
+			Client:  client.NewMock(),
+			readErr: errors.New("rate limited"),
+		}}
+
+		p := Pipe{prefetcher: fakeNixShaPrefetcher{}}
+		require.ErrorContains(t, p.doPublish(ctx, foo, cli), "rate limited")
+
+		require.Len(t, cli.writes, 1, "the main derivation write happens before the NUR read, but default.nix must not be written")
+	})
+}
+
+// fakeFileGetterClient wraps a client.Client and implements
+// fileContentGetter, serving canned content for a set of paths, to exercise
+// the read-merge-write path of a shared NUR/overlay repository. readErr, if
+// set, is returned for every path instead, to exercise error propagation.
+type fakeFileGetterClient struct {
+	client.Client
+	files   map[string][]byte
+	readErr error
+}
+
+func (f *fakeFileGetterClient) GetFileContent(_ *context.Context, _ client.Repo, path string) ([]byte, error) {
+	if f.readErr != nil {
+		return nil, f.readErr
+	}
+	content, ok := f.files[path]
+	if !ok {
+		return nil, errFileNotExist
+	}
+	return content, nil
+}
+
+func TestCachixPush(t *testing.T) {
+	ctx := testctx.NewWithCfg(config.Project{
+		Dist: t.TempDir(),
+		Nix: []config.Nix{{
+			Name:       "foo",
+			Path:       "pkgs/foo/default.nix",
+			Repository: config.RepoRef{Owner: "foo", Name: "bar"},
+			Cachix: config.NixCachix{
+				Name: "my-cache",
+				Push: true,
+			},
+		}},
+	})
+	ctx.Artifacts.Add(&artifact.Artifact{
+		Name: "foo.tar.gz",
+		Goos: "linux", Goarch: "amd64",
+		Type: artifact.UploadableArchive,
+		Extra: map[string]interface{}{
+			artifact.ExtraID:        "foo",
+			artifact.ExtraFormat:    "tar.gz",
+			artifact.ExtraBinaries:  []string{"foo"},
+			artifact.ExtraWrappedIn: "",
+		},
+	})
+
+	t.Run("pushes the built store path", func(t *testing.T) {
+		pusher := &fakeBinaryCachePusher{available: true}
+		p := Pipe{
+			prefetcher: fakeNixShaPrefetcher{},
+			pusher:     pusher,
+			buildDrv: func(path string) (string, error) {
+				require.Equal(t, artifact.Path(ctx, "nix", "foo", "default.nix"), path)
+				bts, err := os.ReadFile(path)
+				require.NoError(t, err)
+				require.NotEmpty(t, bts)
+				return "/nix/store/abc-foo-1.0.0", nil
+			},
+		}
+		require.NoError(t, p.doPublish(ctx, ctx.Config.Nix[0], client.NewMock()))
+		require.Equal(t, []string{"/nix/store/abc-foo-1.0.0"}, pusher.pushed)
+	})
+
+	t.Run("build failure is surfaced", func(t *testing.T) {
+		p := Pipe{
+			prefetcher: fakeNixShaPrefetcher{},
+			pusher:     &fakeBinaryCachePusher{available: true},
+			buildDrv: func(path string) (string, error) {
+				return "", errors.New("boom")
+			},
+		}
+		require.ErrorContains(t, p.doPublish(ctx, ctx.Config.Nix[0], client.NewMock()), "boom")
+	})
+}
+
 func TestErrNoArchivesFound(t *testing.T) {
 	require.EqualError(t, errNoArchivesFound{
 		goamd64: "v1",
@@ -547,6 +947,62 @@ func TestBinInstallFormats(t *testing.T) {
 	})
 }
 
+func TestAuxOutputs(t *testing.T) {
+	man := func() *artifact.Artifact {
+		return &artifact.Artifact{Extra: map[string]interface{}{
+			artifact.ExtraManPages: []string{"foo.1.gz"},
+		}}
+	}
+	completions := func() *artifact.Artifact {
+		return &artifact.Artifact{Extra: map[string]interface{}{
+			artifact.ExtraCompletions: map[string]string{"bash": "foo.bash", "fish": "foo.fish"},
+		}}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		require.Empty(t, auxOutputs(config.Nix{}, []*artifact.Artifact{man()}))
+	})
+	t.Run("man only", func(t *testing.T) {
+		require.Equal(t, []string{"man"}, auxOutputs(config.Nix{Outputs: config.NixOutputs{Enabled: true}}, []*artifact.Artifact{man()}))
+	})
+	t.Run("completions only", func(t *testing.T) {
+		require.Equal(t, []string{"bash", "fish"}, auxOutputs(config.Nix{Outputs: config.NixOutputs{Enabled: true}}, []*artifact.Artifact{completions()}))
+	})
+	t.Run("man and completions", func(t *testing.T) {
+		require.Equal(t, []string{"man", "bash", "fish"}, auxOutputs(config.Nix{Outputs: config.NixOutputs{Enabled: true}}, []*artifact.Artifact{man(), completions()}))
+	})
+}
+
+func TestFlakeSystems(t *testing.T) {
+	archives := func(pairs ...[3]string) []*artifact.Artifact {
+		var result []*artifact.Artifact
+		for _, p := range pairs {
+			result = append(result, &artifact.Artifact{Goos: p[0], Goarch: p[1], Goarm: p[2]})
+		}
+		return result
+	}
+
+	t.Run("dedups and sorts", func(t *testing.T) {
+		require.Equal(t, []string{"aarch64-linux", "x86_64-darwin", "x86_64-linux"}, flakeSystems(archives(
+			[3]string{"linux", "amd64", ""},
+			[3]string{"linux", "amd64", ""},
+			[3]string{"linux", "arm64", ""},
+			[3]string{"darwin", "amd64", ""},
+		)))
+	})
+
+	t.Run("arm variants", func(t *testing.T) {
+		require.Equal(t, []string{"armv6l-linux", "armv7l-linux"}, flakeSystems(archives(
+			[3]string{"linux", "arm", "6"},
+			[3]string{"linux", "arm", "7"},
+		)))
+	})
+
+	t.Run("unknown pair is ignored", func(t *testing.T) {
+		require.Empty(t, flakeSystems(archives([3]string{"windows", "amd64", ""})))
+	})
+}
+
 func darwinDep(s string) config.NixDependency {
 	return config.NixDependency{
 		Name: s,
@@ -566,4 +1022,19 @@ type fakeNixShaPrefetcher map[string]string
 func (m fakeNixShaPrefetcher) Prefetch(url string) (string, error) {
 	return m[url], nil
 }
+func (m fakeNixShaPrefetcher) PrefetchVendor(src string) (string, error) {
+	return m[src], nil
+}
 func (m fakeNixShaPrefetcher) Available() bool { return true }
+
+type fakeBinaryCachePusher struct {
+	available bool
+	pushed    []string
+}
+
+func (f *fakeBinaryCachePusher) Push(drvPath string) error {
+	f.pushed = append(f.pushed, drvPath)
+	return nil
+}
+
+func (f fakeBinaryCachePusher) Available() bool { return f.available }